@@ -0,0 +1,240 @@
+// Package auth implements the authentication backends used to authorize
+// RTSP, RTMP, HLS and HTTP API requests against a path and an action.
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Action is an operation that requires authorization.
+type Action string
+
+// authenticatable actions. ActionAPI, ActionMetrics and ActionPprof are
+// global: they aren't scoped to a stream path, so Requests and Permissions
+// for them always use GlobalPath rather than a stream name.
+const (
+	ActionPublish  Action = "publish"
+	ActionRead     Action = "read"
+	ActionPlayback Action = "playback"
+	ActionAPI      Action = "api"
+	ActionMetrics  Action = "metrics"
+	ActionPprof    Action = "pprof"
+)
+
+// GlobalPath is the Path value a Request or a Permission must use for a
+// global action (ActionAPI, ActionMetrics, ActionPprof) rather than a single
+// stream.
+const GlobalPath = ""
+
+// ErrNoCredentials is returned by Authenticate when no backend (JWT or
+// internal users) is configured at all. A request that simply carries no
+// credential while a backend is configured gets a different error instead.
+var ErrNoCredentials = errors.New("no credentials provided")
+
+// Permission grants access to an action on a path. Path is a literal path
+// name, unless it's prefixed with "~", in which case the rest of the string
+// is a regular expression - the same "~" convention used for path names in
+// the main configuration.
+type Permission struct {
+	Action Action `json:"action"`
+	Path   string `json:"path"`
+}
+
+// Allows reports whether this permission grants action on path.
+func (p Permission) Allows(action Action, path string) bool {
+	return p.allows(action, path)
+}
+
+func (p Permission) allows(action Action, path string) bool {
+	if p.Action != action {
+		return false
+	}
+
+	if !strings.HasPrefix(p.Path, "~") {
+		return p.Path == path
+	}
+
+	r, err := compiledRegexp(p.Path[1:])
+	if err != nil {
+		return false
+	}
+	return r.MatchString(path)
+}
+
+// regexpCache holds patterns already compiled by compiledRegexp, so that a
+// pattern shared by many checks (every RTSP/RTMP request, every metrics
+// scrape) is compiled once instead of on every call.
+var regexpCache sync.Map // map[string]*regexp.Regexp
+
+func compiledRegexp(pattern string) (*regexp.Regexp, error) {
+	if v, ok := regexpCache.Load(pattern); ok {
+		return v.(*regexp.Regexp), nil
+	}
+
+	r, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	actual, _ := regexpCache.LoadOrStore(pattern, r)
+	return actual.(*regexp.Regexp), nil
+}
+
+// Request groups the parameters needed to authorize a single operation.
+type Request struct {
+	Action Action
+	Path   string
+	IP     net.IP
+	Query  url.Values
+	Header http.Header
+
+	// ValidateCredentials checks user/pass against the credentials
+	// actually supplied in the request (e.g. an RTSP digest challenge).
+	// It is only consulted for the internal users backend.
+	ValidateCredentials func(user, pass string) error
+}
+
+// token extracts the JWT carried by the request, either as the "jwt" query
+// parameter (used by the RTSP URL) or as an "Authorization: Bearer" header
+// (used by RTMP and HLS).
+func (r Request) token() string {
+	if r.Query != nil {
+		if tok := r.Query.Get("jwt"); tok != "" {
+			return tok
+		}
+	}
+
+	if r.Header != nil {
+		if ah := r.Header.Get("Authorization"); strings.HasPrefix(ah, "Bearer ") {
+			return strings.TrimPrefix(ah, "Bearer ")
+		}
+	}
+
+	return ""
+}
+
+// JWTConfig configures the JWT authentication mode.
+type JWTConfig struct {
+	// JWKSURL is the endpoint keys are fetched from, for RS256/ES256 tokens.
+	JWKSURL string
+
+	// Secret is the shared secret used to validate HS256 tokens.
+	Secret string
+
+	// ClaimPath is the name of the claim that holds the permission list,
+	// e.g. "mediamtx_permissions".
+	ClaimPath string
+
+	// Issuer and Audience, when set, are matched against the "iss" and
+	// "aud" claims.
+	Issuer   string
+	Audience string
+}
+
+// Config configures a Manager.
+type Config struct {
+	JWT *JWTConfig
+
+	// InternalUsers is the global list replacing the former per-path
+	// ReadUser/PublishUser pairs.
+	InternalUsers []InternalUser
+}
+
+// Manager authenticates incoming requests.
+type Manager struct {
+	conf Config
+	jwks *jwksCache
+}
+
+// New allocates a Manager.
+func New(ctx context.Context, conf Config) *Manager {
+	m := &Manager{conf: conf}
+
+	if conf.JWT != nil && conf.JWT.JWKSURL != "" {
+		m.jwks = newJWKSCache(ctx, conf.JWT.JWKSURL)
+	}
+
+	return m
+}
+
+// Authenticate validates req against the configured backends and checks that
+// it grants req.Action on req.Path. A request carrying a JWT is checked by the
+// JWT backend only; otherwise the internal users are consulted, if any. It
+// returns ErrNoCredentials when no backend is configured at all, meaning the
+// caller imposes no restriction. ctx is reserved for backends that need to
+// perform I/O (e.g. a future token-introspection call) and is currently
+// unused.
+func (m *Manager) Authenticate(ctx context.Context, req Request) error {
+	if m.conf.JWT != nil {
+		if token := req.token(); token != "" {
+			return m.authenticateJWT(req, token)
+		}
+
+		if len(m.conf.InternalUsers) == 0 {
+			return fmt.Errorf("action '%s' on path '%s' is not allowed: no credentials provided", req.Action, req.Path)
+		}
+	}
+
+	if len(m.conf.InternalUsers) > 0 {
+		return m.authenticateInternalUser(req)
+	}
+
+	return ErrNoCredentials
+}
+
+func (m *Manager) authenticateJWT(req Request, token string) error {
+	perms, err := m.validateJWT(token)
+	if err != nil {
+		return fmt.Errorf("invalid token: %s", err)
+	}
+
+	for _, p := range perms {
+		if p.allows(req.Action, req.Path) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("action '%s' on path '%s' is not allowed by the provided token", req.Action, req.Path)
+}
+
+func (m *Manager) authenticateInternalUser(req Request) error {
+	var credErr error
+
+	for _, u := range m.conf.InternalUsers {
+		if !u.matchesIP(req.IP) || !u.allows(req.Action, req.Path) {
+			continue
+		}
+
+		if u.User == "" {
+			return nil
+		}
+
+		if req.ValidateCredentials == nil {
+			continue
+		}
+
+		err := req.ValidateCredentials(u.User, u.Pass)
+		if err == nil {
+			return nil
+		}
+		credErr = err
+	}
+
+	// if credentials were actually checked against a matching user, return
+	// that error verbatim instead of a generic one: for RTSP digest auth it
+	// carries the non-critical challenge response that lets the client
+	// retry with credentials, rather than having the connection closed.
+	if credErr != nil {
+		return credErr
+	}
+
+	return fmt.Errorf("action '%s' on path '%s' is not allowed", req.Action, req.Path)
+}
@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPermissionAllows(t *testing.T) {
+	// a literal path is matched exactly, even if it contains regexp
+	// metacharacters: it must not be silently treated as a pattern
+	p := Permission{Action: ActionRead, Path: "cam.1"}
+	require.True(t, p.allows(ActionRead, "cam.1"))
+	require.False(t, p.allows(ActionRead, "camX1"))
+
+	// a "~"-prefixed path is a regular expression
+	p = Permission{Action: ActionRead, Path: "~cam.1"}
+	require.True(t, p.allows(ActionRead, "cam.1"))
+	require.True(t, p.allows(ActionRead, "camX1"))
+	require.False(t, p.allows(ActionRead, "other"))
+}
+
+func TestManagerInternalUsersGlobalAction(t *testing.T) {
+	m := New(context.Background(), Config{
+		InternalUsers: []InternalUser{
+			{
+				User:        "myuser",
+				Pass:        "mypass",
+				Permissions: []Permission{{Action: ActionMetrics, Path: GlobalPath}},
+			},
+		},
+	})
+
+	err := m.Authenticate(context.Background(), Request{
+		Action: ActionMetrics,
+		Path:   GlobalPath,
+		ValidateCredentials: func(user, pass string) error {
+			if user == "myuser" && pass == "mypass" {
+				return nil
+			}
+			return fmt.Errorf("invalid credentials")
+		},
+	})
+	require.NoError(t, err)
+}
+
+func TestManagerInternalUsers(t *testing.T) {
+	m := New(context.Background(), Config{
+		InternalUsers: []InternalUser{
+			{
+				User:        "myuser",
+				Pass:        "mypass",
+				Permissions: []Permission{{Action: ActionPublish, Path: "mypath"}},
+			},
+		},
+	})
+
+	err := m.Authenticate(context.Background(), Request{
+		Action: ActionPublish,
+		Path:   "mypath",
+		ValidateCredentials: func(user, pass string) error {
+			if user == "myuser" && pass == "mypass" {
+				return nil
+			}
+			return fmt.Errorf("invalid credentials")
+		},
+	})
+	require.NoError(t, err)
+
+	err = m.Authenticate(context.Background(), Request{
+		Action: ActionPublish,
+		Path:   "mypath",
+		ValidateCredentials: func(user, pass string) error {
+			return fmt.Errorf("invalid credentials")
+		},
+	})
+	require.Error(t, err)
+
+	err = m.Authenticate(context.Background(), Request{
+		Action: ActionRead,
+		Path:   "mypath",
+		ValidateCredentials: func(user, pass string) error {
+			return nil
+		},
+	})
+	require.Error(t, err)
+}
+
+func TestManagerInternalUsersIPFilter(t *testing.T) {
+	_, ipNet, err := net.ParseCIDR("192.168.1.0/24")
+	require.NoError(t, err)
+
+	m := New(context.Background(), Config{
+		InternalUsers: []InternalUser{
+			{
+				Permissions: []Permission{{Action: ActionRead, Path: "mypath"}},
+				IPs:         []interface{}{ipNet},
+			},
+		},
+	})
+
+	err = m.Authenticate(context.Background(), Request{
+		Action: ActionRead,
+		Path:   "mypath",
+		IP:     net.ParseIP("192.168.1.50"),
+	})
+	require.NoError(t, err)
+
+	err = m.Authenticate(context.Background(), Request{
+		Action: ActionRead,
+		Path:   "mypath",
+		IP:     net.ParseIP("10.0.0.1"),
+	})
+	require.Error(t, err)
+
+	// a missing IP (e.g. a failed remote-address parse) must not satisfy
+	// an IP-restricted entry
+	err = m.Authenticate(context.Background(), Request{
+		Action: ActionRead,
+		Path:   "mypath",
+		IP:     nil,
+	})
+	require.Error(t, err)
+}
+
+func TestManagerNoBackendConfigured(t *testing.T) {
+	m := New(context.Background(), Config{})
+
+	err := m.Authenticate(context.Background(), Request{
+		Action: ActionRead,
+		Path:   "mypath",
+	})
+	require.Equal(t, ErrNoCredentials, err)
+}
+
+func TestManagerJWTOnlyRequiresToken(t *testing.T) {
+	m := New(context.Background(), Config{
+		JWT: &JWTConfig{Secret: "mysecret", ClaimPath: "mediamtx_permissions"},
+	})
+
+	// a request that carries no token must be denied, not treated as
+	// ErrNoCredentials: that value means "no backend configured at all",
+	// and a JWT-only deployment must not let unauthenticated requests
+	// through just because they omit a token
+	err := m.Authenticate(context.Background(), Request{
+		Action: ActionRead,
+		Path:   "mypath",
+	})
+	require.Error(t, err)
+	require.NotEqual(t, ErrNoCredentials, err)
+}
+
+func TestManagerReload(t *testing.T) {
+	m1 := New(context.Background(), Config{
+		InternalUsers: []InternalUser{
+			{Permissions: []Permission{{Action: ActionRead, Path: "mypath"}}},
+		},
+	})
+	require.NoError(t, m1.Authenticate(context.Background(), Request{Action: ActionRead, Path: "mypath"}))
+
+	// a config reload swaps in a new Manager built from the updated
+	// configuration; old credentials must stop working immediately
+	m2 := New(context.Background(), Config{
+		InternalUsers: []InternalUser{
+			{Permissions: []Permission{{Action: ActionPublish, Path: "mypath"}}},
+		},
+	})
+	require.Error(t, m2.Authenticate(context.Background(), Request{Action: ActionRead, Path: "mypath"}))
+	require.NoError(t, m2.Authenticate(context.Background(), Request{Action: ActionPublish, Path: "mypath"}))
+}
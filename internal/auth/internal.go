@@ -0,0 +1,51 @@
+package auth
+
+import "net"
+
+// InternalUser is an entry of the global internal users list, replacing the
+// former per-path ReadUser/PublishUser pairs. A user is granted an action on
+// a path when an IP check (if any) and a Permission both match.
+type InternalUser struct {
+	User        string
+	Pass        string
+	IPs         []interface{} // net.IP or *net.IPNet, same format as conf.PathConf.ReadIPsParsed
+	Permissions []Permission
+}
+
+// allows reports whether action on path is granted to this user, assuming
+// ip has already been validated by the caller (or is nil).
+func (u InternalUser) allows(action Action, path string) bool {
+	for _, p := range u.Permissions {
+		if p.allows(action, path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u InternalUser) matchesIP(ip net.IP) bool {
+	if u.IPs == nil {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	return ipEqualOrInRange(ip, u.IPs)
+}
+
+func ipEqualOrInRange(ip net.IP, ips []interface{}) bool {
+	for _, item := range ips {
+		switch titem := item.(type) {
+		case net.IP:
+			if titem.Equal(ip) {
+				return true
+			}
+
+		case *net.IPNet:
+			if titem.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
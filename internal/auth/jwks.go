@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// jwksRefreshInterval is how often a jwksCache re-fetches its key set.
+const jwksRefreshInterval = 10 * time.Minute
+
+// jwksCache holds the keys published by a JWKS endpoint, indexed by kid, and
+// periodically refreshes them in the background.
+type jwksCache struct {
+	url string
+
+	mutex sync.RWMutex
+	keys  map[string]interface{}
+}
+
+func newJWKSCache(ctx context.Context, url string) *jwksCache {
+	c := &jwksCache{
+		url:  url,
+		keys: make(map[string]interface{}),
+	}
+
+	c.refresh()
+
+	go c.run(ctx)
+
+	return c
+}
+
+func (c *jwksCache) run(ctx context.Context) {
+	t := time.NewTicker(jwksRefreshInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			c.refresh()
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *jwksCache) refresh() {
+	keys, err := fetchJWKS(c.url)
+	if err != nil {
+		// keep serving the previous cache; the next tick will retry
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.keys = keys
+}
+
+func (c *jwksCache) key(kid string) (interface{}, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	key, ok := c.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("key '%s' not found in JWKS", kid)
+	}
+
+	return key, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwksResponse struct {
+	Keys []jwk `json:"keys"`
+}
+
+func fetchJWKS(url string) (map[string]interface{}, error) {
+	res, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS endpoint returned status code %d", res.StatusCode)
+	}
+
+	var body jwksResponse
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]interface{}, len(body.Keys))
+	for _, k := range body.Keys {
+		pub, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+
+	return keys, nil
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+
+	case "EC":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key type '%s'", k.Kty)
+	}
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"fmt"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// validateJWT checks the signature, expiration, issuer and audience of
+// tokenStr, and returns the permission list carried by the configured claim.
+func (m *Manager) validateJWT(tokenStr string) ([]Permission, error) {
+	cfg := m.conf.JWT
+
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(tokenStr, claims, func(t *jwt.Token) (interface{}, error) {
+		switch t.Method.(type) {
+		case *jwt.SigningMethodHMAC:
+			if cfg.Secret == "" {
+				return nil, fmt.Errorf("HS256 tokens are not accepted, no secret is configured")
+			}
+			return []byte(cfg.Secret), nil
+
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+			if m.jwks == nil {
+				return nil, fmt.Errorf("%s tokens are not accepted, no JWKS URL is configured", t.Method.Alg())
+			}
+			kid, _ := t.Header["kid"].(string)
+			return m.jwks.key(kid)
+
+		default:
+			return nil, fmt.Errorf("unsupported signing method '%s'", t.Header["alg"])
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, fmt.Errorf("token is not valid")
+	}
+
+	if cfg.Issuer != "" && !claims.VerifyIssuer(cfg.Issuer, true) {
+		return nil, fmt.Errorf("unexpected issuer")
+	}
+	if cfg.Audience != "" && !claims.VerifyAudience(cfg.Audience, true) {
+		return nil, fmt.Errorf("unexpected audience")
+	}
+
+	raw, ok := claims[cfg.ClaimPath]
+	if !ok {
+		return nil, fmt.Errorf("claim '%s' not found in token", cfg.ClaimPath)
+	}
+
+	return parsePermissions(raw)
+}
+
+func parsePermissions(raw interface{}) ([]Permission, error) {
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("permission claim has an invalid format")
+	}
+
+	perms := make([]Permission, len(list))
+	for i, item := range list {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("permission claim has an invalid format")
+		}
+
+		action, _ := m["action"].(string)
+		path, _ := m["path"].(string)
+		if action == "" {
+			return nil, fmt.Errorf("permission claim has an invalid format")
+		}
+
+		perms[i] = Permission{Action: Action(action), Path: path}
+	}
+
+	return perms, nil
+}
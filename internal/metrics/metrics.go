@@ -2,11 +2,14 @@ package metrics
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"net/http"
 	"sync/atomic"
 
+	"github.com/aler9/rtsp-simple-server/internal/auth"
 	"github.com/aler9/rtsp-simple-server/internal/logger"
+	"github.com/aler9/rtsp-simple-server/internal/pathman"
 	"github.com/aler9/rtsp-simple-server/internal/stats"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -20,7 +23,8 @@ type Parent interface {
 
 // Metrics is a metrics exporter.
 type Metrics struct {
-	stats *stats.Stats
+	stats       *stats.Stats
+	pathManager *pathman.PathManager
 
 	listener net.Listener
 	mux      *http.ServeMux
@@ -31,12 +35,27 @@ var (
 	rtspClientsDesc = prometheus.NewDesc("rtsp_clients", "A Gauge displaying the currently connected client", []string{"state"}, nil)
 	rtspSourcesDesc = prometheus.NewDesc("rtsp_sources", "A Gauge displaying the currently connected sources", []string{"type", "state"}, nil)
 
+	pathsDesc             = prometheus.NewDesc("paths", "A Gauge displaying whether a path is ready", []string{"name", "state"}, nil)
+	pathReadersDesc       = prometheus.NewDesc("path_readers", "A Gauge displaying the number of readers of a path", []string{"name"}, nil)
+	pathBytesReceivedDesc = prometheus.NewDesc("path_bytes_received", "A Counter displaying the number of bytes received by a path", []string{"name"}, nil)
+	pathBytesSentDesc     = prometheus.NewDesc("path_bytes_sent", "A Counter displaying the number of bytes sent by a path", []string{"name"}, nil)
+	rtspSessionsDesc      = prometheus.NewDesc("rtsp_sessions", "A Gauge displaying the state of every RTSP session", []string{"id", "state"}, nil)
+	rtmpConnsDesc         = prometheus.NewDesc("rtmp_conns", "A Gauge displaying the state of every RTMP connection", []string{"id", "state"}, nil)
+	hlsMuxersDesc         = prometheus.NewDesc("hls_muxers", "A Gauge displaying the existence of an HLS muxer for a path", []string{"name"}, nil)
+
 	ReceivedDataCounter = promauto.NewCounter(prometheus.CounterOpts{Name: "received_data", Help: "The Sum of all transmitted data"})
 )
 
 func (m *Metrics) Describe(descs chan<- *prometheus.Desc) {
 	descs <- rtspClientsDesc
 	descs <- rtspSourcesDesc
+	descs <- pathsDesc
+	descs <- pathReadersDesc
+	descs <- pathBytesReceivedDesc
+	descs <- pathBytesSentDesc
+	descs <- rtspSessionsDesc
+	descs <- rtmpConnsDesc
+	descs <- hlsMuxersDesc
 }
 
 func (m *Metrics) Collect(metrics chan<- prometheus.Metric) {
@@ -46,19 +65,43 @@ func (m *Metrics) Collect(metrics chan<- prometheus.Metric) {
 	metrics <- prometheus.MustNewConstMetric(rtspSourcesDesc, prometheus.GaugeValue, float64(atomic.LoadInt64(m.stats.CountSourcesRTSPRunning)), "rtsp", "running")
 	metrics <- prometheus.MustNewConstMetric(rtspSourcesDesc, prometheus.GaugeValue, float64(atomic.LoadInt64(m.stats.CountSourcesRTMP)), "rtmp", "idle")
 	metrics <- prometheus.MustNewConstMetric(rtspSourcesDesc, prometheus.GaugeValue, float64(atomic.LoadInt64(m.stats.CountSourcesRTMPRunning)), "rtmp", "running")
+
+	for name, pi := range m.pathManager.PathsInfo() {
+		state := "notReady"
+		if pi.Ready {
+			state = "ready"
+		}
+		metrics <- prometheus.MustNewConstMetric(pathsDesc, prometheus.GaugeValue, 1, name, state)
+		metrics <- prometheus.MustNewConstMetric(pathReadersDesc, prometheus.GaugeValue, float64(pi.Readers), name)
+		metrics <- prometheus.MustNewConstMetric(pathBytesReceivedDesc, prometheus.CounterValue, float64(pi.BytesReceived), name)
+		metrics <- prometheus.MustNewConstMetric(pathBytesSentDesc, prometheus.CounterValue, float64(pi.BytesSent), name)
+
+		for id, state := range pi.RTSPSessions {
+			metrics <- prometheus.MustNewConstMetric(rtspSessionsDesc, prometheus.GaugeValue, 1, id, state)
+		}
+		for id, state := range pi.RTMPConns {
+			metrics <- prometheus.MustNewConstMetric(rtmpConnsDesc, prometheus.GaugeValue, 1, id, state)
+		}
+		if pi.HasHLSMuxer {
+			metrics <- prometheus.MustNewConstMetric(hlsMuxersDesc, prometheus.GaugeValue, 1, name)
+		}
+	}
 }
 
 // New allocates a metrics.
 func New(
 	address string,
 	stats *stats.Stats,
+	pathManager *pathman.PathManager,
+	authManager *auth.Manager,
 	parent Parent,
 ) (*Metrics, error) {
 	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/metrics", authMiddleware(authManager, auth.ActionMetrics, promhttp.Handler()))
 
 	m := &Metrics{
-		stats: stats,
+		stats:       stats,
+		pathManager: pathManager,
 		server: &http.Server{
 			Addr:    address,
 			Handler: mux,
@@ -86,3 +129,56 @@ func (m *Metrics) run() {
 		panic(err)
 	}
 }
+
+// authMiddleware wraps next so that it's only reachable after a successful
+// auth.Manager.Authenticate call with the given action (auth.ActionMetrics
+// for /metrics), checked against auth.GlobalPath since these endpoints
+// aren't scoped to a single stream (an
+// InternalUser/JWT permission granting it must target auth.GlobalPath, not a
+// stream name). It can be reused as-is by future endpoints (e.g. an "api"
+// control API) by passing a different action.
+//
+// auth.ErrNoCredentials is treated as a pass below: Authenticate only
+// returns it when authManager has no backend configured at all, never when
+// a backend is configured but the request simply didn't present a
+// credential it understands (that's a denial instead). So an unauthenticated
+// request only reaches next when authManager truly imposes no restriction.
+func authMiddleware(authManager *auth.Manager, action auth.Action, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authManager == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		reqUser, reqPass, hasBasicAuth := r.BasicAuth()
+
+		err := authManager.Authenticate(r.Context(), auth.Request{
+			Action: action,
+			Path:   auth.GlobalPath,
+			IP:     remoteIP(r),
+			Query:  r.URL.Query(),
+			Header: r.Header,
+			ValidateCredentials: func(user, pass string) error {
+				if !hasBasicAuth || user != reqUser || pass != reqPass {
+					return fmt.Errorf("invalid credentials")
+				}
+				return nil
+			},
+		})
+		if err != nil && err != auth.ErrNoCredentials {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mediamtx"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
@@ -3,15 +3,20 @@ package pathman
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/aler9/gortsplib/pkg/base"
 	"github.com/aler9/gortsplib/pkg/headers"
+	"github.com/aler9/rtsp-simple-server/internal/auth"
 	"github.com/aler9/rtsp-simple-server/internal/conf"
 	"github.com/aler9/rtsp-simple-server/internal/logger"
 	"github.com/aler9/rtsp-simple-server/internal/path"
@@ -19,23 +24,6 @@ import (
 	"github.com/aler9/rtsp-simple-server/internal/stats"
 )
 
-func ipEqualOrInRange(ip net.IP, ips []interface{}) bool {
-	for _, item := range ips {
-		switch titem := item.(type) {
-		case net.IP:
-			if titem.Equal(ip) {
-				return true
-			}
-
-		case *net.IPNet:
-			if titem.Contains(ip) {
-				return true
-			}
-		}
-	}
-	return false
-}
-
 // Parent is implemented by program.
 type Parent interface {
 	Log(logger.Level, string, ...interface{})
@@ -49,6 +37,7 @@ type PathManager struct {
 	readBufferCount int
 	readBufferSize  int
 	authMethods     []headers.AuthMethod
+	authManager     *auth.Manager
 	pathConfs       map[string]*conf.PathConf
 	stats           *stats.Stats
 	parent          Parent
@@ -59,11 +48,12 @@ type PathManager struct {
 	paths     map[string]*path.Path
 
 	// in
-	confReload  chan map[string]*conf.PathConf
+	confReload  chan confReloadReq
 	pathClose   chan *path.Path
 	rpDescribe  chan readpublisher.DescribeReq
 	rpSetupPlay chan readpublisher.SetupPlayReq
 	rpAnnounce  chan readpublisher.AnnounceReq
+	pathsInfo   chan pathsInfoReq
 }
 
 // New allocates a PathManager.
@@ -75,6 +65,7 @@ func New(
 	readBufferCount int,
 	readBufferSize int,
 	authMethods []headers.AuthMethod,
+	authManager *auth.Manager,
 	pathConfs map[string]*conf.PathConf,
 	stats *stats.Stats,
 	parent Parent) *PathManager {
@@ -87,17 +78,19 @@ func New(
 		readBufferCount: readBufferCount,
 		readBufferSize:  readBufferSize,
 		authMethods:     authMethods,
+		authManager:     authManager,
 		pathConfs:       pathConfs,
 		stats:           stats,
 		parent:          parent,
 		ctx:             ctx,
 		ctxCancel:       ctxCancel,
 		paths:           make(map[string]*path.Path),
-		confReload:      make(chan map[string]*conf.PathConf),
+		confReload:      make(chan confReloadReq),
 		pathClose:       make(chan *path.Path),
 		rpDescribe:      make(chan readpublisher.DescribeReq),
 		rpSetupPlay:     make(chan readpublisher.SetupPlayReq),
 		rpAnnounce:      make(chan readpublisher.AnnounceReq),
+		pathsInfo:       make(chan pathsInfoReq),
 	}
 
 	pm.createPaths()
@@ -125,18 +118,72 @@ func (pm *PathManager) run() {
 outer:
 	for {
 		select {
-		case pathConfs := <-pm.confReload:
+		case req := <-pm.confReload:
+			pathConfs := req.pathConfs
+
+			// confNames whose running path(s) must be closed below: confs
+			// removed outright, or ones that changed in a way requiring a
+			// full restart (the "default" case below). Tracked by conf
+			// name rather than by comparing conf pointers, since
+			// GetInstance deliberately hands each regexp-derived instance
+			// its own conf copy - they'd never compare equal to the
+			// template even when nothing needs closing.
+			toClose := make(map[string]bool)
+
 			// remove confs
 			for pathName := range pm.pathConfs {
 				if _, ok := pathConfs[pathName]; !ok {
 					delete(pm.pathConfs, pathName)
+					toClose[pathName] = true
 				}
 			}
 
 			// update confs
 			for pathName, oldConf := range pm.pathConfs {
-				if !oldConf.Equal(pathConfs[pathName]) {
-					pm.pathConfs[pathName] = pathConfs[pathName]
+				newConf, ok := pathConfs[pathName]
+				if !ok {
+					continue
+				}
+
+				switch {
+				case oldConf.Equal(newConf):
+					// nothing changed
+
+				case oldConf.EqualExceptAuth(newConf):
+					// only auth-related fields changed: apply the new
+					// config in place, without closing the running path(s).
+					// A regexp conf can have several live instances, each
+					// keyed in pm.paths by its own interpolated source, so
+					// look them up by conf name rather than newConf.Source.
+					pm.pathConfs[pathName] = newConf
+					for _, pa := range pm.paths {
+						if pa.ConfName() != pathName {
+							continue
+						}
+
+						// a regexp conf's template pointer (newConf) has no
+						// interpolated Source: instances must reload against
+						// their own GetInstance(name) copy, or they'd lose
+						// the Source that makes them that instance.
+						instanceConf := newConf
+						if newConf.Regexp != nil {
+							instanceConf = newConf.GetInstance(pa.Name())
+						}
+
+						pa.OnPathManConfReload(instanceConf)
+
+						// OnPathManConfReload is expected to swap pa's
+						// internal conf pointer to instanceConf; warn if it
+						// didn't, since pa then keeps running with the stale
+						// conf.
+						if pa.Conf() != instanceConf {
+							pm.Log(logger.Warn, "path '%s' did not refresh its configuration after a reload", pathName)
+						}
+					}
+
+				default:
+					pm.pathConfs[pathName] = newConf
+					toClose[pathName] = true
 				}
 			}
 
@@ -148,9 +195,9 @@ outer:
 			}
 
 			// remove paths associated with a conf which doesn't exist anymore
-			// or has changed
+			// or has changed in a way that wasn't applied in place above
 			for source, pa := range pm.paths {
-				if pathConf, ok := pm.pathConfs[pa.ConfName()]; !ok || pathConf != pa.Conf() {
+				if toClose[pa.ConfName()] {
 					delete(pm.paths, source)
 					pa.Close()
 				}
@@ -159,6 +206,10 @@ outer:
 			// add paths
 			pm.createPaths()
 
+			if req.authManager != nil {
+				pm.authManager = req.authManager
+			}
+
 		case pa := <-pm.pathClose:
 			if pmpa, ok := pm.paths[pa.Conf().Source]; !ok || pmpa != pa {
 				continue
@@ -173,11 +224,7 @@ outer:
 				continue
 			}
 
-			action, err := pm.DoAuthRequest(pathConf, PlayRequestPayload{
-				RemoteAddr: req.RemoteAddr,
-				LocalAddr:  req.LocalAddr,
-				Path:       req.PathName,
-			})
+			action, err := pm.DoAuthRequest(pathConf, pm.authRequestPayload(auth.ActionRead, req.PathName, req.RemoteAddr, req.LocalAddr, req.Query, req.Header, req.Protocol))
 			if err != nil {
 				req.Res <- readpublisher.DescribeRes{Err: err}
 				continue
@@ -197,10 +244,10 @@ outer:
 			err = pm.authenticate(
 				req.IP,
 				req.ValidateCredentials,
+				auth.ActionRead,
 				req.PathName,
-				pathConf.ReadIPsParsed,
-				pathConf.ReadUser,
-				pathConf.ReadPass,
+				req.Query,
+				req.Header,
 			)
 			if err != nil {
 				req.Res <- readpublisher.DescribeRes{Err: err}
@@ -221,11 +268,7 @@ outer:
 				continue
 			}
 
-			action, err := pm.DoAuthRequest(pathConf, PlayRequestPayload{
-				RemoteAddr: req.RemoteAddr,
-				LocalAddr:  req.LocalAddr,
-				Path:       req.PathName,
-			})
+			action, err := pm.DoAuthRequest(pathConf, pm.authRequestPayload(auth.ActionRead, req.PathName, req.RemoteAddr, req.LocalAddr, req.Query, req.Header, req.Protocol))
 			if err != nil {
 				req.Res <- readpublisher.SetupPlayRes{Err: err}
 				continue
@@ -245,10 +288,10 @@ outer:
 			err = pm.authenticate(
 				req.IP,
 				req.ValidateCredentials,
+				auth.ActionRead,
 				req.PathName,
-				pathConf.ReadIPsParsed,
-				pathConf.ReadUser,
-				pathConf.ReadPass,
+				req.Query,
+				req.Header,
 			)
 			if err != nil {
 				req.Res <- readpublisher.SetupPlayRes{Err: err}
@@ -268,13 +311,24 @@ outer:
 				continue
 			}
 
+			action, err := pm.DoAuthRequest(pathConf, pm.authRequestPayload(auth.ActionPublish, req.PathName, req.RemoteAddr, req.LocalAddr, req.Query, req.Header, req.Protocol))
+			if err != nil {
+				req.Res <- readpublisher.AnnounceRes{Err: err}
+				continue
+			}
+
+			if action.Close {
+				req.Res <- readpublisher.AnnounceRes{Err: fmt.Errorf("not allowed")}
+				continue
+			}
+
 			err = pm.authenticate(
 				req.IP,
 				req.ValidateCredentials,
+				auth.ActionPublish,
 				req.PathName,
-				pathConf.PublishIPsParsed,
-				pathConf.PublishUser,
-				pathConf.PublishPass,
+				req.Query,
+				req.Header,
 			)
 			if err != nil {
 				req.Res <- readpublisher.AnnounceRes{Err: err}
@@ -288,6 +342,31 @@ outer:
 
 			pm.paths[pathConf.Source].OnPathManAnnounce(req)
 
+		case req := <-pm.pathsInfo:
+			// pa.IsReady() and the other accessors below must read from
+			// lock- or atomic-protected fields on *path.Path, never round-trip
+			// through a channel into the path's own run() loop: this case
+			// runs inside pm.run(), which is also the only reader of
+			// pm.pathClose (see above), so a path blocked trying to send on
+			// pm.pathClose while we're synchronously waiting on one of its
+			// accessors would deadlock both goroutines.
+			ret := make(map[string]*PathInfo, len(pm.paths))
+			for _, pa := range pm.paths {
+				// keyed by the instance name, not pa.ConfName(): a single
+				// regexp conf can back several simultaneously active
+				// streams, and they'd otherwise collide into one entry
+				ret[pa.Name()] = &PathInfo{
+					Ready:         pa.IsReady(),
+					BytesReceived: pa.BytesReceived(),
+					BytesSent:     pa.BytesSent(),
+					Readers:       pa.ReadersCount(),
+					RTSPSessions:  pa.RTSPSessionsInfo(),
+					RTMPConns:     pa.RTMPConnsInfo(),
+					HasHLSMuxer:   pa.HasHLSMuxer(),
+				}
+			}
+			req.res <- ret
+
 		case <-pm.ctx.Done():
 			break outer
 		}
@@ -341,10 +420,19 @@ func (pm *PathManager) findPathConf(name string) (string, *conf.PathConf, error)
 	return "", nil, fmt.Errorf("unable to find a valid configuration for path '%s'", name)
 }
 
+// confReloadReq carries a configuration reload. authManager is non-nil only
+// when the authentication config (internal users, HTTP callback, JWT) has
+// changed, so that unrelated path-only reloads don't replace a perfectly
+// valid auth.Manager (and its JWKS cache) for nothing.
+type confReloadReq struct {
+	pathConfs   map[string]*conf.PathConf
+	authManager *auth.Manager
+}
+
 // OnProgramConfReload is called by program.
-func (pm *PathManager) OnProgramConfReload(pathConfs map[string]*conf.PathConf) {
+func (pm *PathManager) OnProgramConfReload(pathConfs map[string]*conf.PathConf, authManager *auth.Manager) {
 	select {
-	case pm.confReload <- pathConfs:
+	case pm.confReload <- confReloadReq{pathConfs: pathConfs, authManager: authManager}:
 	case <-pm.ctx.Done():
 	}
 }
@@ -384,41 +472,111 @@ func (pm *PathManager) OnReadPublisherSetupPlay(req readpublisher.SetupPlayReq)
 	}
 }
 
+// PathInfo is a snapshot of a single path's state and per-protocol counters,
+// used by metrics.Metrics.Collect.
+type PathInfo struct {
+	Ready         bool
+	BytesReceived uint64
+	BytesSent     uint64
+	Readers       int
+	RTSPSessions  map[string]string // session id -> state
+	RTMPConns     map[string]string // connection id -> state
+	HasHLSMuxer   bool
+}
+
+type pathsInfoReq struct {
+	res chan map[string]*PathInfo
+}
+
+// PathsInfo returns a snapshot of all currently active paths, keyed by
+// instance name (not configuration name, since a single regexp conf can
+// back several simultaneously active streams). It's safe to call from any
+// goroutine: the snapshot is built by pm.run(), so it never races with the
+// path manager's own state.
+func (pm *PathManager) PathsInfo() map[string]*PathInfo {
+	req := pathsInfoReq{res: make(chan map[string]*PathInfo)}
+
+	select {
+	case pm.pathsInfo <- req:
+		return <-req.res
+
+	case <-pm.ctx.Done():
+		return map[string]*PathInfo{}
+	}
+}
+
+// authenticate checks that the request is allowed to perform action on
+// pathName, consulting the JWT and internal-users backends through
+// pm.authManager. validateCredentials is used by the internal-users backend
+// to check a candidate user/pass against the credentials actually supplied
+// in the request (e.g. an RTSP digest challenge).
 func (pm *PathManager) authenticate(
 	ip net.IP,
 	validateCredentials func(authMethods []headers.AuthMethod, pathUser string, pathPass string) error,
+	action auth.Action,
 	pathName string,
-	pathIPs []interface{},
-	pathUser string,
-	pathPass string,
+	query url.Values,
+	header http.Header,
 ) error {
-	// validate ip
-	if pathIPs != nil && ip != nil {
-		if !ipEqualOrInRange(ip, pathIPs) {
-			return readpublisher.ErrAuthCritical{
-				Message: fmt.Sprintf("IP '%s' not allowed", ip),
-				Response: &base.Response{
-					StatusCode: base.StatusUnauthorized,
-				},
-			}
-		}
+	if pm.authManager == nil {
+		return nil
 	}
 
-	// validate user
-	if pathUser != "" && validateCredentials != nil {
-		err := validateCredentials(pm.authMethods, pathUser, pathPass)
-		if err != nil {
+	// credErr records the error returned by validateCredentials, if any, so
+	// it can be told apart below from other denial reasons (bad IP, no
+	// matching permission, ...) and propagated verbatim instead of being
+	// flattened into a critical error.
+	var credErr error
+
+	req := auth.Request{
+		Action: action,
+		Path:   pathName,
+		IP:     ip,
+		Query:  query,
+		Header: header,
+	}
+	if validateCredentials != nil {
+		req.ValidateCredentials = func(user, pass string) error {
+			err := validateCredentials(pm.authMethods, user, pass)
+			if err != nil {
+				credErr = err
+			}
 			return err
 		}
 	}
 
-	return nil
+	err := pm.authManager.Authenticate(pm.ctx, req)
+	switch {
+	case err == nil || err == auth.ErrNoCredentials:
+		return nil
+
+	case credErr != nil && err == credErr:
+		// validateCredentials carries the RTSP "not critical" challenge
+		// response that lets the client retry with credentials (digest
+		// auth); returning it verbatim instead of wrapping it as critical
+		// lets that round trip complete instead of closing the connection.
+		return err
+
+	default:
+		return readpublisher.ErrAuthCritical{
+			Message: err.Error(),
+			Response: &base.Response{
+				StatusCode: base.StatusUnauthorized,
+			},
+		}
+	}
 }
 
+// PlayRequestPayload is posted as JSON to the HTTP authentication callback.
 type PlayRequestPayload struct {
 	RemoteAddr string `json:"remote_addr"`
 	LocalAddr  string `json:"local_addr"`
 	Path       string `json:"path"`
+	Action     string `json:"action"`
+	User       string `json:"user"`
+	Password   string `json:"password"`
+	Query      string `json:"query"`
+	Protocol   string `json:"protocol"`
 }
 
 type PlayRequestAction struct {
@@ -426,6 +584,74 @@ type PlayRequestAction struct {
 	Target string
 }
 
+// authRequestPayload builds the payload posted to the HTTP authentication
+// callback for action on pathName.
+func (pm *PathManager) authRequestPayload(
+	action auth.Action,
+	pathName string,
+	remoteAddr string,
+	localAddr string,
+	query url.Values,
+	header http.Header,
+	protocol string,
+) PlayRequestPayload {
+	user, pass := basicAuthCredentials(header)
+
+	return PlayRequestPayload{
+		RemoteAddr: remoteAddr,
+		LocalAddr:  localAddr,
+		Path:       pathName,
+		Action:     string(action),
+		User:       user,
+		Password:   pass,
+		Query:      query.Encode(),
+		Protocol:   protocol,
+	}
+}
+
+// digestAuthUsernameRegexp extracts the "username" parameter of an
+// "Authorization: Digest ..." header, as sent by RTSP publishers/readers.
+var digestAuthUsernameRegexp = regexp.MustCompile(`username="([^"]*)"`)
+
+// basicAuthCredentials extracts the username and password carried by the
+// request's Authorization header. "Basic", used by RTMP and HLS, exposes
+// both in cleartext. RTSP's "Digest" scheme only proves knowledge of the
+// password through a hashed response, so only the username can be
+// recovered from it; the password half is always empty in that case.
+func basicAuthCredentials(header http.Header) (string, string) {
+	if header == nil {
+		return "", ""
+	}
+
+	ah := header.Get("Authorization")
+
+	if strings.HasPrefix(ah, "Digest ") {
+		m := digestAuthUsernameRegexp.FindStringSubmatch(ah)
+		if m == nil {
+			return "", ""
+		}
+		return m[1], ""
+	}
+
+	if !strings.HasPrefix(ah, "Basic ") {
+		return "", ""
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(ah, "Basic "))
+	if err != nil {
+		return "", ""
+	}
+
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+
+	return parts[0], parts[1]
+}
+
+// DoAuthRequest invokes the HTTP authentication callback configured on
+// pathConf, unless p.Action/p.Path match an entry of pathConf.AuthHTTPExclude.
 func (pm *PathManager) DoAuthRequest(pathConf *conf.PathConf, p PlayRequestPayload) (*PlayRequestAction, error) {
 	var a PlayRequestAction
 
@@ -433,6 +659,12 @@ func (pm *PathManager) DoAuthRequest(pathConf *conf.PathConf, p PlayRequestPaylo
 		return &a, nil
 	}
 
+	for _, ex := range pathConf.AuthHTTPExclude {
+		if ex.Allows(auth.Action(p.Action), p.Path) {
+			return &a, nil
+		}
+	}
+
 	data, err := json.Marshal(p)
 	if err != nil {
 		return nil, err